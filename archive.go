@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// iterationRecord is one run.json entry: a single test binary invocation's
+// wall-clock duration and exit status.
+type iterationRecord struct {
+	Package  string `json:"package"`
+	Duration string `json:"duration"`
+	Success  bool   `json:"success"`
+}
+
+type jobRecord struct {
+	Rev           string            `json:"rev"`
+	Config        string            `json:"config"`
+	BuildFailures []string          `json:"buildFailures,omitempty"`
+	Iterations    []iterationRecord `json:"iterations"`
+}
+
+// runRecord describes a full benchwrap invocation for run.json: the flags
+// and revs it was given, and each job's per-iteration results.
+type runRecord struct {
+	Args  []string          `json:"args"`
+	Flags map[string]string `json:"flags"`
+	Revs  []string          `json:"revs"`
+	Jobs  []jobRecord       `json:"jobs"`
+}
+
+func writeRunRecord(path string, args []string, revs []*rev, jobs []*job) error {
+	rr := &runRecord{Args: args, Flags: map[string]string{}}
+	flag.VisitAll(func(f *flag.Flag) {
+		rr.Flags[f.Name] = f.Value.String()
+	})
+	for _, r := range revs {
+		rr.Revs = append(rr.Revs, r.sha1)
+	}
+	for _, j := range jobs {
+		rr.Jobs = append(rr.Jobs, jobRecord{
+			Rev:           j.rev.sha1,
+			Config:        j.config.Name,
+			BuildFailures: j.buildFailures,
+			Iterations:    j.iterations,
+		})
+	}
+	b, err := json.MarshalIndent(rr, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// metaHeader renders a golang.org/x/perf-style benchmark file header for
+// rev, so an archived raw file carries enough machine and commit metadata
+// to be meaningful on its own.
+func metaHeader(repo *git.Repository, r *rev) (string, error) {
+	commit, err := repo.CommitObject(plumbing.NewHash(r.sha1))
+	if err != nil {
+		return "", err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "commit: %s\n", r.sha1)
+	fmt.Fprintf(&b, "commit-time: %s\n", commit.Committer.When.Format(time.RFC3339))
+	fmt.Fprintf(&b, "branch: %s\n", r.name)
+	fmt.Fprintf(&b, "goos: %s\n", runtime.GOOS)
+	fmt.Fprintf(&b, "goarch: %s\n", runtime.GOARCH)
+	fmt.Fprintf(&b, "cpu: %s\n", cpuModel())
+	fmt.Fprintf(&b, "go-version: %s\n", goVersion())
+	fmt.Fprintf(&b, "hostname: %s\n", hostname)
+	fmt.Fprintf(&b, "date: %s\n", time.Now().Format(time.RFC3339))
+	return b.String(), nil
+}
+
+func goVersion() string {
+	if out, err := run("go", "version"); err == nil {
+		return string(out)
+	}
+	return runtime.Version()
+}
+
+func cpuModel() string {
+	if out, err := ioutil.ReadFile("/proc/cpuinfo"); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "model name") {
+				if i := strings.Index(line, ":"); i >= 0 {
+					return strings.TrimSpace(line[i+1:])
+				}
+			}
+		}
+	}
+	if out, err := run("sysctl", "-n", "machdep.cpu.brand_string"); err == nil {
+		return string(out)
+	}
+	return "unknown"
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteRunRecord(t *testing.T) {
+	revs := []*rev{
+		{name: "v1", sha1: "aaaa111122223333444455556666777788889999"},
+		{name: "v2", sha1: "bbbb111122223333444455556666777788889999"},
+	}
+	jobs := []*job{
+		{
+			rev:           revs[0],
+			config:        &Configuration{Name: "default"},
+			buildFailures: []string{"example.com/bad"},
+			iterations: []iterationRecord{
+				{Package: "example.com/good", Duration: "1.5s", Success: true},
+			},
+		},
+		{
+			rev:    revs[1],
+			config: &Configuration{Name: "default"},
+			iterations: []iterationRecord{
+				{Package: "example.com/good", Duration: "2s", Success: false},
+			},
+		},
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "run.json")
+	args := []string{"v1", "v2"}
+	if err := writeRunRecord(path, args, revs, jobs); err != nil {
+		t.Fatalf("writeRunRecord: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	var rr runRecord
+	if err := json.Unmarshal(b, &rr); err != nil {
+		t.Fatalf("unmarshalling run.json: %v", err)
+	}
+
+	if len(rr.Args) != 2 || rr.Args[0] != "v1" || rr.Args[1] != "v2" {
+		t.Fatalf("Args = %v, want %v", rr.Args, args)
+	}
+	if len(rr.Revs) != 2 || rr.Revs[0] != revs[0].sha1 || rr.Revs[1] != revs[1].sha1 {
+		t.Fatalf("Revs = %v, want %v", rr.Revs, []string{revs[0].sha1, revs[1].sha1})
+	}
+	if v, ok := rr.Flags["n"]; !ok || v != "10" {
+		t.Fatalf("Flags[\"n\"] = %q, %v, want \"10\", true", v, ok)
+	}
+
+	if len(rr.Jobs) != 2 {
+		t.Fatalf("Jobs = %v, want 2 entries", rr.Jobs)
+	}
+	first := rr.Jobs[0]
+	if first.Rev != revs[0].sha1 || first.Config != "default" {
+		t.Fatalf("Jobs[0] = %+v, want Rev=%s Config=default", first, revs[0].sha1)
+	}
+	if len(first.BuildFailures) != 1 || first.BuildFailures[0] != "example.com/bad" {
+		t.Fatalf("Jobs[0].BuildFailures = %v, want [example.com/bad]", first.BuildFailures)
+	}
+	if len(first.Iterations) != 1 || !first.Iterations[0].Success {
+		t.Fatalf("Jobs[0].Iterations = %v, want one successful iteration", first.Iterations)
+	}
+
+	second := rr.Jobs[1]
+	if len(second.BuildFailures) != 0 {
+		t.Fatalf("Jobs[1].BuildFailures = %v, want none", second.BuildFailures)
+	}
+	if len(second.Iterations) != 1 || second.Iterations[0].Success {
+		t.Fatalf("Jobs[1].Iterations = %v, want one failed iteration", second.Iterations)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Configuration is one named way to build and run the benchmarks: its own
+// build/run flags, environment, and an optional wrapper command (e.g.
+// []string{"perf", "stat", "--"} or []string{"taskset", "-c", "2"}).
+type Configuration struct {
+	Name       string
+	GcFlags    string
+	BuildFlags string
+	GcEnv      []string
+	RunEnv     []string
+	RunWrapper []string
+	GoRoot     string
+	Disabled   bool
+}
+
+type tomlConfig struct {
+	Configurations []Configuration
+}
+
+// defaultConfiguration is used when no -config file is given, so plain
+// -gt-flags/-pkgs usage keeps working exactly as before.
+func defaultConfiguration() Configuration {
+	return Configuration{Name: "default"}
+}
+
+// loadConfigurations reads the TOML file at path and returns its enabled
+// configurations. If path is empty it returns the implicit default
+// configuration.
+func loadConfigurations(path string) ([]Configuration, error) {
+	if path == "" {
+		return []Configuration{defaultConfiguration()}, nil
+	}
+	var tc tomlConfig
+	if _, err := toml.DecodeFile(path, &tc); err != nil {
+		return nil, err
+	}
+	var configs []Configuration
+	seen := make(map[string]bool)
+	for _, c := range tc.Configurations {
+		if c.Disabled {
+			continue
+		}
+		if c.Name == "" {
+			return nil, fmt.Errorf("%s: configuration missing a name", path)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("%s: configuration name %q is used more than once", path, c.Name)
+		}
+		seen[c.Name] = true
+		configs = append(configs, c)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no enabled configurations in %s", path)
+	}
+	return configs, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigurationsDefault(t *testing.T) {
+	configs, err := loadConfigurations("")
+	if err != nil {
+		t.Fatalf("loadConfigurations(\"\") error: %v", err)
+	}
+	if len(configs) != 1 || configs[0].Name != "default" {
+		t.Fatalf("loadConfigurations(\"\") = %+v, want a single default configuration", configs)
+	}
+}
+
+func TestLoadConfigurationsFromFile(t *testing.T) {
+	const toml = `
+[[configurations]]
+name = "plain"
+
+[[configurations]]
+name = "tuned"
+gcflags = "-l"
+runenv = ["GOMAXPROCS=1"]
+
+[[configurations]]
+name = "off"
+disabled = true
+`
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bw.toml")
+	if err := os.WriteFile(path, []byte(toml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	configs, err := loadConfigurations(path)
+	if err != nil {
+		t.Fatalf("loadConfigurations(%q) error: %v", path, err)
+	}
+	var names []string
+	for _, c := range configs {
+		names = append(names, c.Name)
+	}
+	want := []string{"plain", "tuned"}
+	if len(names) != len(want) || names[0] != want[0] || names[1] != want[1] {
+		t.Fatalf("loadConfigurations(%q) names = %v, want %v (disabled configuration should be excluded)", path, names, want)
+	}
+}
+
+func TestLoadConfigurationsDuplicateName(t *testing.T) {
+	const toml = `
+[[configurations]]
+name = "plain"
+
+[[configurations]]
+name = "plain"
+gcflags = "-l"
+`
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bw.toml")
+	if err := os.WriteFile(path, []byte(toml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadConfigurations(path); err == nil {
+		t.Fatalf("loadConfigurations(%q) with a duplicate name: want error, got nil", path)
+	}
+}
+
+func TestLoadConfigurationsMissingName(t *testing.T) {
+	const toml = `
+[[configurations]]
+gcflags = "-l"
+`
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bw.toml")
+	if err := os.WriteFile(path, []byte(toml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadConfigurations(path); err == nil {
+		t.Fatalf("loadConfigurations(%q) with no name: want error, got nil", path)
+	}
+}
+
+func TestLoadConfigurationsAllDisabled(t *testing.T) {
+	const toml = `
+[[configurations]]
+name = "off"
+disabled = true
+`
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bw.toml")
+	if err := os.WriteFile(path, []byte(toml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadConfigurations(path); err == nil {
+		t.Fatalf("loadConfigurations(%q) with every configuration disabled: want error, got nil", path)
+	}
+}
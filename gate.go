@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+
+	"golang.org/x/tools/benchmark/parse"
+)
+
+// regression is one benchmark/metric pair whose median moved beyond the
+// -fail-on-regress or -fail-on-improve threshold between the first and
+// last revision, with p < 0.05.
+type regression struct {
+	Benchmark    string
+	Config       string
+	Metric       string
+	Old          float64
+	New          float64
+	PercentDelta float64
+	PValue       float64
+	Improved     bool
+}
+
+func (r regression) String() string {
+	dir := "regressed"
+	if r.Improved {
+		dir = "improved"
+	}
+	return fmt.Sprintf("%s [%s] %s: %.2f -> %.2f (%+.1f%%, p=%.4f) %s",
+		r.Benchmark, r.Config, r.Metric, r.Old, r.New, r.PercentDelta, r.PValue, dir)
+}
+
+// checkRegressions compares the first and last revision's benchmark output
+// for every enabled configuration and reports any benchmark whose ns/op or
+// B/op median moved beyond failRegress or failImprove percent with p < 0.05.
+// only and ignore, if non-nil, restrict which benchmark names are considered,
+// independently of the -bench flag used to select what actually ran.
+func checkRegressions(revs []*rev, jobs []*job, only, ignore *regexp.Regexp, failRegress, failImprove float64) ([]regression, error) {
+	if len(revs) < 2 {
+		return nil, fmt.Errorf("-fail-on-regress/-fail-on-improve need at least 2 revisions")
+	}
+	first, last := revs[0], revs[len(revs)-1]
+
+	oldJobs := make(map[string]*job)
+	newJobs := make(map[string]*job)
+	for _, j := range jobs {
+		switch j.rev {
+		case first:
+			oldJobs[j.config.Name] = j
+		case last:
+			newJobs[j.config.Name] = j
+		}
+	}
+
+	var regressions []regression
+	for name, oj := range oldJobs {
+		nj, ok := newJobs[name]
+		if !ok {
+			return nil, fmt.Errorf("-fail-on-regress/-fail-on-improve: config %q has no %s job to compare against", name, last.name)
+		}
+		if oj.failed || nj.failed {
+			return nil, fmt.Errorf("-fail-on-regress/-fail-on-improve: config %q could not be compared: %s failed", name, failedRevName(oj, nj, first, last))
+		}
+		oldSet, err := parse.ParseSet(bytes.NewReader(oj.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", oj.label(), err)
+		}
+		newSet, err := parse.ParseSet(bytes.NewReader(nj.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", nj.label(), err)
+		}
+		for bname, oldBenches := range oldSet {
+			if only != nil && !only.MatchString(bname) {
+				continue
+			}
+			if ignore != nil && ignore.MatchString(bname) {
+				continue
+			}
+			newBenches, ok := newSet[bname]
+			if !ok {
+				continue
+			}
+			for _, metric := range []string{"ns/op", "B/op"} {
+				oldVals := extractMetric(oldBenches, metric)
+				newVals := extractMetric(newBenches, metric)
+				if len(oldVals) == 0 || len(newVals) == 0 {
+					continue
+				}
+				om, nm := median(oldVals), median(newVals)
+				if om == 0 {
+					continue
+				}
+				pct := (nm - om) / om * 100
+				_, p := welchTTest(oldVals, newVals)
+				r := regression{
+					Benchmark:    bname,
+					Config:       name,
+					Metric:       metric,
+					Old:          om,
+					New:          nm,
+					PercentDelta: pct,
+					PValue:       p,
+				}
+				switch {
+				case failRegress > 0 && pct > failRegress && p < 0.05:
+					regressions = append(regressions, r)
+				case failImprove > 0 && pct < -failImprove && p < 0.05:
+					r.Improved = true
+					regressions = append(regressions, r)
+				}
+			}
+		}
+	}
+	return regressions, nil
+}
+
+// failedRevName names which of oj/nj's revisions (first/last) failed to
+// build or run, for the error checkRegressions reports when a comparison
+// can't be made.
+func failedRevName(oj, nj *job, first, last *rev) string {
+	switch {
+	case oj.failed && nj.failed:
+		return first.name + " and " + last.name
+	case oj.failed:
+		return first.name
+	default:
+		return last.name
+	}
+}
+
+// extractMetric pulls the given metric's samples out of a benchmark's
+// repeated runs, skipping entries where it wasn't measured.
+func extractMetric(benches []*parse.Benchmark, metric string) []float64 {
+	var vals []float64
+	for _, b := range benches {
+		switch metric {
+		case "ns/op":
+			if b.Measured&parse.NsPerOp != 0 {
+				vals = append(vals, b.NsPerOp)
+			}
+		case "B/op":
+			if b.Measured&parse.AllocedBytesPerOp != 0 {
+				vals = append(vals, float64(b.AllocedBytesPerOp))
+			}
+		}
+	}
+	return vals
+}
+
+func median(vals []float64) float64 {
+	sorted := append([]float64(nil), vals...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+func mean(vals []float64) float64 {
+	var sum float64
+	for _, v := range vals {
+		sum += v
+	}
+	return sum / float64(len(vals))
+}
+
+func variance(vals []float64, m float64) float64 {
+	if len(vals) < 2 {
+		return 0
+	}
+	var ss float64
+	for _, v := range vals {
+		d := v - m
+		ss += d * d
+	}
+	return ss / float64(len(vals)-1)
+}
+
+// welchTTest runs a two-sample Welch's t-test and approximates its p-value
+// from the standard normal distribution rather than the Student's
+// t-distribution, which is close enough for the sample sizes benchwrap
+// deals with (tens of iterations, not a handful).
+func welchTTest(a, b []float64) (t, p float64) {
+	n1, n2 := float64(len(a)), float64(len(b))
+	m1, m2 := mean(a), mean(b)
+	v1, v2 := variance(a, m1), variance(b, m2)
+	se := math.Sqrt(v1/n1 + v2/n2)
+	if se == 0 {
+		if m1 == m2 {
+			return 0, 1
+		}
+		return math.Inf(1), 0
+	}
+	t = (m2 - m1) / se
+	p = 2 * (1 - normalCDF(math.Abs(t)))
+	return t, p
+}
+
+func normalCDF(x float64) float64 {
+	return 0.5 * (1 + math.Erf(x/math.Sqrt2))
+}
+
+// compileOptionalRegexp compiles pattern, or returns a nil *regexp.Regexp
+// (matching nothing restricted) if pattern is empty.
+func compileOptionalRegexp(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
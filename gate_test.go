@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMedian(t *testing.T) {
+	cases := []struct {
+		name string
+		vals []float64
+		want float64
+	}{
+		{"odd", []float64{3, 1, 2}, 2},
+		{"even", []float64{1, 2, 3, 4}, 2.5},
+		{"single", []float64{42}, 42},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := median(c.vals); got != c.want {
+				t.Errorf("median(%v) = %v, want %v", c.vals, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCheckRegressionsFailedJobErrors(t *testing.T) {
+	first := &rev{name: "old"}
+	last := &rev{name: "new"}
+	cfg := &Configuration{Name: "default"}
+
+	jobs := []*job{
+		{rev: first, config: cfg},
+		{rev: last, config: cfg, failed: true},
+	}
+
+	_, err := checkRegressions([]*rev{first, last}, jobs, nil, nil, 10, 0)
+	if err == nil {
+		t.Fatal("checkRegressions with a failed job: want error, got nil")
+	}
+}
+
+func TestCheckRegressionsMissingConfigErrors(t *testing.T) {
+	first := &rev{name: "old"}
+	last := &rev{name: "new"}
+
+	jobs := []*job{
+		{rev: first, config: &Configuration{Name: "default"}},
+	}
+
+	_, err := checkRegressions([]*rev{first, last}, jobs, nil, nil, 10, 0)
+	if err == nil {
+		t.Fatal("checkRegressions with a config missing from the new rev: want error, got nil")
+	}
+}
+
+func TestWelchTTest(t *testing.T) {
+	cases := []struct {
+		name  string
+		a, b  []float64
+		wantP func(p float64) bool
+	}{
+		{
+			name: "identical samples",
+			a:    []float64{10, 10, 10, 10},
+			b:    []float64{10, 10, 10, 10},
+			wantP: func(p float64) bool {
+				return p == 1
+			},
+		},
+		{
+			name: "clearly separated samples",
+			a:    []float64{100, 101, 99, 100, 102, 98},
+			b:    []float64{200, 201, 199, 200, 202, 198},
+			wantP: func(p float64) bool {
+				return p < 0.01
+			},
+		},
+		{
+			name: "noisy but overlapping samples",
+			a:    []float64{100, 150, 90, 140, 95},
+			b:    []float64{105, 95, 145, 85, 150},
+			wantP: func(p float64) bool {
+				return p > 0.5
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, p := welchTTest(c.a, c.b)
+			if math.IsNaN(p) {
+				t.Fatalf("welchTTest(%v, %v) = NaN p-value", c.a, c.b)
+			}
+			if !c.wantP(p) {
+				t.Errorf("welchTTest(%v, %v) p = %v, did not satisfy expectation", c.a, c.b, p)
+			}
+		})
+	}
+}
@@ -14,32 +14,65 @@
 //
 //	  -bench regexp
 //	        regexp denoting benchmarks to run (go test -bench) (default ".")
+//	  -benchtime string
+//	        forward string to go test -test.benchtime
+//	  -config file.toml
+//	        TOML file of named build/run configurations to cross with the revs
+//	  -count number
+//	        forward number to go test -test.count, repeating each benchmark
+//	        within a single invocation (default 1)
 //	  -delta-test test
 //	        forward test to benchstat -delta-test flag
+//	  -fail-on-improve percent
+//	        exit non-zero if any benchmark's median ns/op or B/op improved
+//	        by more than percent between the first and last rev (p < 0.05)
+//	  -fail-on-regress percent
+//	        exit non-zero if any benchmark's median ns/op or B/op regressed
+//	        by more than percent between the first and last rev (p < 0.05)
 //	  -gt-flags string
-//	        forward quoted string of flags to go test
+//	        forward quoted string of flags to the compiled test binary; bare
+//	        go test runtime flags (e.g. -v, -short, -cpu=1,2,4) are rewritten
+//	        to their -test. form, build-only flags (e.g. -race, -tags) are
+//	        rejected since the binary is already built
 //	  -h-vs-h1
-// 		use HEAD~1 as rev.old and HEAD as rev.new
+//		use HEAD~1 as rev.old and HEAD as rev.new
 //	  -html
 //	        invoke benchstat with -html flag
+//	  -ignore regexp
+//	        exclude benchmarks from -fail-on-regress/-fail-on-improve
+//	  -interleave
+//	        interleave iterations across revisions instead of running them back to back
 //	  -n number
-//	        number of go test invocations per git revision (default 10)
+//	        number of test binary invocations per git revision (default 10)
+//	  -o directory
+//	        write a persistent results directory instead of discarding
+//	        intermediate files: a raw .txt file per rev/configuration
+//	        (with a golang.org/x/perf-style meta header), benchstat.txt
+//	        (and benchstat.html with -html), and a run.json describing
+//	        the invocation
+//	  -only regexp
+//	        restrict which benchmarks -fail-on-regress/-fail-on-improve consider
 //	  -pkgs string
 //	        packages to test (go test [packages]) (default ".")
+//	  -seed number
+//	        seed for the -interleave shuffle (default 1)
+//	  -timeout duration
+//	        forward duration to go test -test.timeout (default 10m, matching
+//	        go test's own default, since the compiled binary run directly by
+//	        benchwrap has no timeout of its own)
 //	  -v    print verbose output to stderr
 //
 // Dependencies:
 //
-// 	go get [-u] rsc.io/benchstat
+//	go get [-u] rsc.io/benchstat
 //
-// Example
+// # Example
 //
 // In a git repository, run all `Foo` benchmarks 10 times each for git tag
 // `v0.42`, commit `cdd48c8a` and branch master, and analyse results with
 // benchstat:
 //
-// 	$ benchwrap -n 10 -bench=Foo v0.42 cdd48c8a master
-//
+//	$ benchwrap -n 10 -bench=Foo v0.42 cdd48c8a master
 package main
 
 import (
@@ -48,22 +81,38 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 	"unicode/utf8"
+
+	git "github.com/go-git/go-git/v5"
 )
 
 var (
-	bench   = flag.String("bench", ".", "`regexp` denoting benchmarks to run (go test -bench)")
-	nflag   = flag.Int("n", 10, "`number` of go test invocations per git revision")
-	hvsh1   = flag.Bool("h-vs-h1", false, "use HEAD~1 as rev.old and HEAD as rev.new")
-	gtpkgs  = flag.String("pkgs", ".", "packages to test (go test [packages])")
-	gtflags = flag.String("gt-flags", "", "forward quoted `string` of flags to go test")
-	bsdelta = flag.String("delta-test", "", "forward `test` to benchstat -delta-test flag")
-	bshtml  = flag.Bool("html", false, "invoke benchstat with -html flag")
-	verbose = flag.Bool("v", false, "print verbose output to stderr")
+	bench       = flag.String("bench", ".", "`regexp` denoting benchmarks to run (go test -bench)")
+	benchtime   = flag.String("benchtime", "", "forward `string` to go test -test.benchtime")
+	cfgFile     = flag.String("config", "", "TOML `file` of named build/run configurations to cross with the revs")
+	count       = flag.Int("count", 1, "forward `number` to go test -test.count, repeating each benchmark within a single invocation")
+	nflag       = flag.Int("n", 10, "`number` of test binary invocations per git revision")
+	hvsh1       = flag.Bool("h-vs-h1", false, "use HEAD~1 as rev.old and HEAD as rev.new")
+	outdir      = flag.String("o", "", "write a persistent results `directory` instead of discarding intermediate files")
+	gtpkgs      = flag.String("pkgs", ".", "packages to test (go test [packages])")
+	gtflags     = flag.String("gt-flags", "", "forward quoted `string` of flags to the compiled test binary")
+	bsdelta     = flag.String("delta-test", "", "forward `test` to benchstat -delta-test flag")
+	bshtml      = flag.Bool("html", false, "invoke benchstat with -html flag")
+	verbose     = flag.Bool("v", false, "print verbose output to stderr")
+	interleave  = flag.Bool("interleave", false, "interleave iterations across revisions instead of running them back to back")
+	seed        = flag.Int64("seed", 1, "seed for the -interleave shuffle")
+	timeout     = flag.Duration("timeout", 10*time.Minute, "forward `duration` to go test -test.timeout")
+	failRegress = flag.Float64("fail-on-regress", 0, "exit non-zero if any benchmark's median ns/op or B/op regressed by more than this `percent` between the first and last rev (p < 0.05)")
+	failImprove = flag.Float64("fail-on-improve", 0, "exit non-zero if any benchmark's median ns/op or B/op improved by more than this `percent` between the first and last rev (p < 0.05)")
+	only        = flag.String("only", "", "`regexp` restricting which benchmarks -fail-on-regress/-fail-on-improve consider")
+	ignore      = flag.String("ignore", "", "`regexp` excluding benchmarks from -fail-on-regress/-fail-on-improve")
 )
 
 func usage() {
@@ -74,11 +123,28 @@ func usage() {
 }
 
 type rev struct {
-	bytes.Buffer
 	name      string
 	sha1      string
 	sha1Short string
-	fpath     string
+	worktree  string
+	pkgDir    string
+}
+
+// job is one (rev, Configuration) pair: one cell of the cartesian product
+// benchwrap runs, collecting its own benchmark output for benchstat.
+type job struct {
+	bytes.Buffer
+	rev           *rev
+	config        *Configuration
+	fpath         string
+	builds        []pkgBuild
+	buildFailures []string
+	failed        bool
+	iterations    []iterationRecord
+}
+
+func (j *job) label() string {
+	return j.rev.sha1Short + "." + j.config.Name
 }
 
 func main() {
@@ -98,16 +164,42 @@ func main() {
 	setupLogging()
 
 	var (
-		args    []string
-		revs    []*rev
-		tmpdir  string
-		nmaxlen int
-		bsargs  []string
-		bsout   []byte
-		out     bytes.Buffer
+		args        []string
+		revs        []*rev
+		configs     []Configuration
+		jobs        []*job
+		repo        *git.Repository
+		tmpdir      string
+		resultsDir  string
+		headers     map[*rev]string
+		nmaxlen     int
+		nfpath      int
+		bsargs      []string
+		bsout       []byte
+		bshtmlout   []byte
+		onlyRe      *regexp.Regexp
+		ignoreRe    *regexp.Regexp
+		regressions []regression
+		out         bytes.Buffer
+		repoRoot    string
+		cwdRel      string
 	)
 
-	currentRevName, err := gitNameRev("HEAD")
+	repo, err = git.PlainOpenWithOptions(".", &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		goto err
+	}
+
+	configs, err = loadConfigurations(*cfgFile)
+	if err != nil {
+		goto err
+	}
+
+	onlyRe, err = compileOptionalRegexp(*only)
+	if err != nil {
+		goto err
+	}
+	ignoreRe, err = compileOptionalRegexp(*ignore)
 	if err != nil {
 		goto err
 	}
@@ -129,31 +221,26 @@ func main() {
 		revs = append(revs, r)
 	}
 
-	for _, rev := range revs {
-		err = gitCheckout(rev.sha1)
+	repoRoot, err = gitRevParseShowToplevel()
+	if err != nil {
+		goto err
+	}
+	cwdRel, err = cwdRelativeToRepoRoot(repoRoot)
+	if err != nil {
+		goto err
+	}
+
+	for _, r := range revs {
+		r.worktree, err = addWorktree(r.sha1)
 		if err != nil {
 			goto err
 		}
-		for i := 0; i < *nflag; i++ {
-			var tmp []byte
-			var args []string
-			args = append(
-				args,
-				"test",
-				*gtpkgs,
-				"-run=NONE",
-				"-bench="+*bench,
-			)
-			if *gtflags != "" {
-				fs := strings.Fields(*gtflags)
-				args = append(args, fs...)
-			}
-			tmp, err = run("go", args...)
-			if err != nil {
-				goto err
-			}
-			log.Printf("%s\n", tmp)
-			rev.Write(tmp)
+		r.pkgDir = filepath.Join(r.worktree, cwdRel)
+	}
+
+	for _, r := range revs {
+		for i := range configs {
+			jobs = append(jobs, &job{rev: r, config: &configs[i]})
 		}
 	}
 
@@ -162,11 +249,109 @@ func main() {
 		goto err
 	}
 
-	for _, rev := range revs {
-		rev.fpath = filepath.Join(tmpdir, rev.sha1Short)
+	resultsDir = tmpdir
+	if *outdir != "" {
+		resultsDir = *outdir
+		err = os.MkdirAll(resultsDir, 0755)
+		if err != nil {
+			goto err
+		}
+	}
+
+	headers = make(map[*rev]string, len(revs))
+	for _, r := range revs {
+		headers[r], err = metaHeader(repo, r)
+		if err != nil {
+			goto err
+		}
+	}
+
+	for _, r := range revs {
+		var pkgs []string
+		pkgs, err = listPackages(r.pkgDir, *gtpkgs)
+		if err != nil {
+			goto err
+		}
+		for _, j := range jobs {
+			if j.rev != r {
+				continue
+			}
+			buildJobPackages(j, pkgs, tmpdir)
+		}
+	}
+
+	if *interleave {
+		order := make([]int, len(jobs))
+		rng := rand.New(rand.NewSource(*seed))
+		for round := 0; round < *nflag; round++ {
+			for i := range order {
+				order[i] = i
+			}
+			rng.Shuffle(len(order), func(i, j int) {
+				order[i], order[j] = order[j], order[i]
+			})
+			for _, idx := range order {
+				j := jobs[idx]
+				if j.failed {
+					continue
+				}
+				for _, b := range j.builds {
+					start := time.Now()
+					var tmp []byte
+					tmp, err = runBenchBinary(j, b)
+					j.iterations = append(j.iterations, iterationRecord{
+						Package:  b.pkg,
+						Duration: time.Since(start).String(),
+						Success:  err == nil,
+					})
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "benchwrap: run failed for %s [%s]: %v\n", b.pkg, j.label(), err)
+						j.failed = true
+						break
+					}
+					log.Printf("%s\n", tmp)
+					j.Write(tmp)
+				}
+			}
+		}
+	} else {
+		for _, j := range jobs {
+			if j.failed {
+				continue
+			}
+			for i := 0; i < *nflag; i++ {
+				for _, b := range j.builds {
+					start := time.Now()
+					var tmp []byte
+					tmp, err = runBenchBinary(j, b)
+					j.iterations = append(j.iterations, iterationRecord{
+						Package:  b.pkg,
+						Duration: time.Since(start).String(),
+						Success:  err == nil,
+					})
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "benchwrap: run failed for %s [%s]: %v\n", b.pkg, j.label(), err)
+						j.failed = true
+						break
+					}
+					log.Printf("%s\n", tmp)
+					j.Write(tmp)
+				}
+				if j.failed {
+					break
+				}
+			}
+		}
+	}
+
+	for _, j := range jobs {
+		if j.failed || j.Len() == 0 {
+			continue
+		}
+		j.fpath = filepath.Join(resultsDir, j.label()+".txt")
 		err = ioutil.WriteFile(
-			rev.fpath,
-			rev.Bytes(),
+			j.fpath,
+			append([]byte(headers[j.rev]), j.Bytes()...),
 			0644,
 		)
 		if err != nil {
@@ -174,14 +359,19 @@ func main() {
 		}
 	}
 
-	if *bshtml {
-		bsargs = append(bsargs, "-html")
-	}
 	if *bsdelta != "" {
 		bsargs = append(bsargs, "-delta-test", *bsdelta)
 	}
-	for _, rev := range revs {
-		bsargs = append(bsargs, rev.fpath)
+	for _, j := range jobs {
+		if j.fpath == "" {
+			continue
+		}
+		bsargs = append(bsargs, j.fpath)
+		nfpath++
+	}
+	if nfpath == 0 {
+		err = fmt.Errorf("no successful benchmark runs to analyse")
+		goto err
 	}
 	bsout, err = run(
 		"benchstat",
@@ -190,6 +380,51 @@ func main() {
 	if err != nil {
 		goto err
 	}
+	if *outdir != "" {
+		err = ioutil.WriteFile(filepath.Join(resultsDir, "benchstat.txt"), bsout, 0644)
+		if err != nil {
+			goto err
+		}
+	}
+	if *bshtml {
+		bshtmlout, err = run(
+			"benchstat",
+			append([]string{"-html"}, bsargs...)...,
+		)
+		if err != nil {
+			goto err
+		}
+		if *outdir != "" {
+			err = ioutil.WriteFile(filepath.Join(resultsDir, "benchstat.html"), bshtmlout, 0644)
+			if err != nil {
+				goto err
+			}
+		}
+		bsout = bshtmlout
+	}
+
+	if *outdir != "" {
+		err = writeRunRecord(filepath.Join(resultsDir, "run.json"), args, revs, jobs)
+		if err != nil {
+			goto err
+		}
+	}
+
+	if *failRegress > 0 || *failImprove > 0 {
+		regressions, err = checkRegressions(revs, jobs, onlyRe, ignoreRe, *failRegress, *failImprove)
+		if err != nil {
+			goto err
+		}
+		if len(regressions) > 0 {
+			var msg strings.Builder
+			fmt.Fprintf(&msg, "%d benchmark(s) outside threshold:\n", len(regressions))
+			for _, r := range regressions {
+				fmt.Fprintf(&msg, "  %s\n", r)
+			}
+			err = fmt.Errorf("%s", msg.String())
+			goto err
+		}
+	}
 
 	for _, rev := range revs {
 		n := utf8.RuneCountInString(rev.name)
@@ -217,7 +452,7 @@ func main() {
 
 	os.Stdout.Write(out.Bytes())
 
-	gitCheckout(currentRevName)
+	removeWorktrees(revs)
 	if tmpdir != "" {
 		err = os.RemoveAll(tmpdir)
 		if err != nil {
@@ -227,7 +462,7 @@ func main() {
 	os.Exit(0)
 
 err:
-	gitCheckout(currentRevName)
+	removeWorktrees(revs)
 	if tmpdir != "" {
 		os.RemoveAll(tmpdir)
 	}
@@ -235,24 +470,92 @@ err:
 	os.Exit(2)
 }
 
-func gitNameRev(rev string) (name string, err error) {
-	out, err := run("git", "name-rev", "--name-only", rev)
-	return string(out), err
+// addWorktree checks out sha1 into a new temporary directory via
+// `git worktree add --detach` and returns its path. go-git's Worktree type
+// isn't used here: it writes HEAD and the index through the Repository's
+// own Storer, so a wtRepo opened with git.Open(repo.Storer, ...) would
+// checkout into the live repository's .git rather than an isolated one.
+// Shelling out to git gives us a genuinely separate worktree, sharing only
+// the object store, and leaves the real repository's HEAD and index alone.
+func addWorktree(sha1 string) (string, error) {
+	parent, err := ioutil.TempDir("", "bw-wt")
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(parent, "wt")
+	_, err = run("git", "worktree", "add", "--detach", dir, sha1)
+	if err != nil {
+		os.RemoveAll(parent)
+		return "", err
+	}
+	return dir, nil
+}
+
+// removeWorktrees tears down every worktree created by addWorktree via
+// `git worktree remove` for each rev.
+func removeWorktrees(revs []*rev) {
+	for _, rev := range revs {
+		if rev.worktree == "" {
+			continue
+		}
+		if _, err := run("git", "worktree", "remove", "--force", rev.worktree); err != nil {
+			log.Println(err)
+		}
+		if err := os.RemoveAll(filepath.Dir(rev.worktree)); err != nil {
+			log.Println(err)
+		}
+	}
 }
 
 func gitRevParseVerify(rev string) (sha1 string, err error) {
-	out, err := run("git", "rev-parse", "--verify", rev)
+	out, err := runIn("", "git", "rev-parse", "--verify", rev)
 	return string(out), err
 }
 
-func gitCheckout(sha1 string) error {
-	_, err := run("git", "checkout", sha1)
-	return err
+// gitRevParseShowToplevel returns the root directory of the git repository
+// containing the current working directory.
+func gitRevParseShowToplevel() (string, error) {
+	out, err := runIn("", "git", "rev-parse", "--show-toplevel")
+	return string(out), err
+}
+
+// cwdRelativeToRepoRoot returns the current working directory's path
+// relative to repoRoot, so -pkgs patterns (which are resolved relative to
+// wherever benchwrap is invoked, e.g. "." or "./...") can be translated into
+// the equivalent directory inside each rev's worktree: the worktree only
+// ever checks out the repository root, so running `go list`/`go test -c`
+// from the worktree root itself would silently reinterpret a pattern given
+// from a subdirectory.
+func cwdRelativeToRepoRoot(repoRoot string) (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(repoRoot, cwd)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("current directory %s is outside git repository %s", cwd, repoRoot)
+	}
+	return rel, nil
 }
 
 func run(command string, args ...string) ([]byte, error) {
+	return runIn("", command, args...)
+}
+
+func runIn(dir, command string, args ...string) ([]byte, error) {
+	return runEnv(dir, nil, command, args...)
+}
+
+// runEnv runs command with args in dir, optionally overriding its
+// environment. A nil env inherits the current process environment.
+func runEnv(dir string, env []string, command string, args ...string) ([]byte, error) {
 	log.Println(strings.Join(append([]string{command}, args...), " "))
 	cmd := exec.Command(command, args...)
+	cmd.Dir = dir
+	cmd.Env = env
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("error: %v\n%s\n", err, out)
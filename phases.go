@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pkgBuild is one compiled test binary for a single package within a job.
+type pkgBuild struct {
+	pkg    string
+	binary string
+}
+
+// listPackages resolves the go test package pattern to its import paths
+// inside the worktree at dir, so each one can be built into its own test
+// binary.
+func listPackages(dir, pattern string) ([]string, error) {
+	out, err := runIn(dir, "go", "list", pattern)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// buildTestBinary builds pkg's test binary once (go test -c), so it can be
+// run -n times without re-linking on every iteration, and returns its path.
+func buildTestBinary(j *job, pkg, outdir string) (string, error) {
+	cfg := j.config
+	binary := filepath.Join(outdir, fmt.Sprintf("%s-%s.test", j.label(), sanitizePkg(pkg)))
+
+	goBin := "go"
+	if cfg.GoRoot != "" {
+		goBin = filepath.Join(cfg.GoRoot, "bin", "go")
+	}
+
+	args := []string{"test", "-c", "-o", binary}
+	if cfg.GcFlags != "" {
+		args = append(args, "-gcflags="+cfg.GcFlags)
+	}
+	if cfg.BuildFlags != "" {
+		args = append(args, strings.Fields(cfg.BuildFlags)...)
+	}
+	args = append(args, pkg)
+
+	env := os.Environ()
+	if cfg.GoRoot != "" {
+		env = append(env, "GOROOT="+cfg.GoRoot)
+	}
+	env = append(env, cfg.GcEnv...)
+
+	_, err := runEnv(j.rev.pkgDir, env, goBin, args...)
+	if err != nil {
+		return "", err
+	}
+	return binary, nil
+}
+
+// buildJobPackages builds every package in pkgs for job j into outdir,
+// appending each successfully built one to j.builds and recording the rest
+// in j.buildFailures. A broken package is reported and skipped rather than
+// failing the whole job, so its siblings still get built and benchmarked.
+func buildJobPackages(j *job, pkgs []string, outdir string) {
+	for _, pkg := range pkgs {
+		binary, err := buildTestBinary(j, pkg, outdir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "benchwrap: build failed for %s [%s]: %v\n", pkg, j.label(), err)
+			j.buildFailures = append(j.buildFailures, pkg)
+			continue
+		}
+		j.builds = append(j.builds, pkgBuild{pkg: pkg, binary: binary})
+	}
+}
+
+// runBenchBinary runs one iteration of a package's pre-built test binary,
+// applying the job's Configuration RunEnv/RunWrapper and any forwarded
+// -bench, -benchtime, -count and -timeout flags.
+func runBenchBinary(j *job, b pkgBuild) ([]byte, error) {
+	cfg := j.config
+	args := []string{
+		"-test.run=NONE",
+		"-test.bench=" + *bench,
+		"-test.benchmem",
+	}
+	if *benchtime != "" {
+		args = append(args, "-test.benchtime="+*benchtime)
+	}
+	if *count > 1 {
+		args = append(args, fmt.Sprintf("-test.count=%d", *count))
+	}
+	if *timeout > 0 {
+		args = append(args, "-test.timeout="+timeout.String())
+	}
+	if *gtflags != "" {
+		gtArgs, err := translateGtFlags(*gtflags)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, gtArgs...)
+	}
+
+	command := b.binary
+	if len(cfg.RunWrapper) > 0 {
+		args = append(append([]string{}, cfg.RunWrapper[1:]...), append([]string{command}, args...)...)
+		command = cfg.RunWrapper[0]
+	}
+
+	env := append(os.Environ(), cfg.RunEnv...)
+	return runEnv(j.rev.pkgDir, env, command, args...)
+}
+
+// runtimeTestFlags are the `go test` flags that the testing package also
+// accepts directly on a compiled `go test -c` binary, under a -test. prefix
+// (see `go doc testing` / `go help testflag`). -gt-flags rewrites bare uses
+// of these into their -test. form, since runBenchBinary invokes the binary
+// directly rather than going through `go test`.
+var runtimeTestFlags = map[string]bool{
+	"bench": true, "benchmem": true, "benchtime": true,
+	"blockprofile": true, "blockprofilerate": true,
+	"count": true, "coverprofile": true, "cpu": true, "cpuprofile": true,
+	"failfast": true, "fuzz": true, "fuzzminimizetime": true, "fuzztime": true,
+	"list": true, "memprofile": true, "memprofilerate": true,
+	"mutexprofile": true, "mutexprofilefraction": true,
+	"outputdir": true, "parallel": true, "run": true, "short": true,
+	"timeout": true, "trace": true, "v": true,
+}
+
+// buildOnlyTestFlags are `go test` flags that only affect compilation and
+// have no -test. runtime equivalent, so they cannot be forwarded to an
+// already-built test binary.
+var buildOnlyTestFlags = map[string]bool{
+	"race": true, "cover": true, "covermode": true, "coverpkg": true,
+	"msan": true, "asan": true, "tags": true, "gcflags": true,
+	"ldflags": true, "asmflags": true, "mod": true, "modfile": true,
+	"overlay": true, "pgo": true, "installsuffix": true, "linkshared": true,
+	"buildvcs": true, "trimpath": true, "work": true, "vet": true,
+}
+
+// translateGtFlags rewrites bare `go test` runtime flags in raw (e.g. -v,
+// -short, -cpu=1,2,4) into the -test.-prefixed form the compiled binary
+// run by runBenchBinary actually understands, and rejects build-only flags
+// (e.g. -race) that a pre-built binary can no longer honor; those belong in
+// the configuration's BuildFlags instead.
+func translateGtFlags(raw string) ([]string, error) {
+	fields := strings.Fields(raw)
+	args := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if !strings.HasPrefix(f, "-") || strings.HasPrefix(f, "-test.") {
+			args = append(args, f)
+			continue
+		}
+		body := strings.TrimLeft(f, "-")
+		name := body
+		if i := strings.IndexByte(body, '='); i >= 0 {
+			name = body[:i]
+		}
+		switch {
+		case buildOnlyTestFlags[name]:
+			return nil, fmt.Errorf("-gt-flags: %q only affects `go test` compilation and can't be forwarded to the already-built test binary; set it in the configuration's BuildFlags instead", f)
+		case runtimeTestFlags[name]:
+			args = append(args, "-test."+body)
+		default:
+			args = append(args, f)
+		}
+	}
+	return args, nil
+}
+
+func sanitizePkg(pkg string) string {
+	return strings.NewReplacer("/", "_", ".", "_").Replace(pkg)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestTranslateGtFlags(t *testing.T) {
+	cases := []struct {
+		name    string
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "bare runtime flags rewritten",
+			raw:  "-v -short -cpu=1,2,4",
+			want: []string{"-test.v", "-test.short", "-test.cpu=1,2,4"},
+		},
+		{
+			name: "already -test. prefixed flags pass through",
+			raw:  "-test.v -test.parallel=2",
+			want: []string{"-test.v", "-test.parallel=2"},
+		},
+		{
+			name: "non-flag arguments pass through",
+			raw:  "-run=Foo plain-arg",
+			want: []string{"-test.run=Foo", "plain-arg"},
+		},
+		{
+			name:    "build-only flag rejected",
+			raw:     "-race",
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := translateGtFlags(c.raw)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("translateGtFlags(%q): want error, got %v", c.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("translateGtFlags(%q) error: %v", c.raw, err)
+			}
+			if len(got) != len(c.want) {
+				t.Fatalf("translateGtFlags(%q) = %v, want %v", c.raw, got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Fatalf("translateGtFlags(%q) = %v, want %v", c.raw, got, c.want)
+				}
+			}
+		})
+	}
+}
+
+// TestBuildJobPackagesIsolatesFailures builds two packages for the same job,
+// one of which fails to compile, and checks that the broken package is
+// recorded in j.buildFailures without preventing its sibling from building
+// and landing in j.builds.
+func TestBuildJobPackagesIsolatesFailures(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go toolchain in PATH")
+	}
+
+	dir := t.TempDir()
+	writeFile(t, dir, "go.mod", "module bwtest\n\ngo 1.21\n")
+	writeFile(t, dir, "good/good.go", "package good\n\nfunc Add(a, b int) int { return a + b }\n")
+	writeFile(t, dir, "good/good_test.go", `package good
+
+import "testing"
+
+func BenchmarkAdd(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		Add(1, 2)
+	}
+}
+`)
+	writeFile(t, dir, "bad/bad.go", "package bad\n\nfunc Broken( {\n")
+
+	pkgs, err := listPackages(dir, "./...")
+	if err != nil {
+		t.Fatalf("listPackages: %v", err)
+	}
+	if len(pkgs) != 2 {
+		t.Fatalf("listPackages returned %v, want 2 packages", pkgs)
+	}
+
+	j := &job{
+		rev:    &rev{name: "HEAD", sha1Short: "abcde", worktree: dir, pkgDir: dir},
+		config: &Configuration{Name: "default"},
+	}
+	outdir := t.TempDir()
+
+	buildJobPackages(j, pkgs, outdir)
+
+	if len(j.buildFailures) != 1 || j.buildFailures[0] != "bwtest/bad" {
+		t.Fatalf("j.buildFailures = %v, want [bwtest/bad]", j.buildFailures)
+	}
+	if len(j.builds) != 1 || j.builds[0].pkg != "bwtest/good" {
+		t.Fatalf("j.builds = %v, want the good package only", j.builds)
+	}
+	if _, err := os.Stat(j.builds[0].binary); err != nil {
+		t.Fatalf("built binary missing: %v", err)
+	}
+}
+
+func writeFile(t *testing.T, dir, rel, content string) {
+	t.Helper()
+	path := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}